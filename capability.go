@@ -0,0 +1,295 @@
+/**
+ * capability.go
+ *
+ * Copyright (c) 2021 Forest Hoffman. All Rights Reserved.
+ * License: MIT License (see the included LICENSE file) or download at
+ *     https://raw.githubusercontent.com/foresthoffman/rwb/master/LICENSE
+ */
+
+package rwb
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+)
+
+// flushPending sends whatever's been buffered so far to the underlying ResponseWriter,
+// the same way Commit does, but without running postProcess or closing the buffer, and
+// unlike Flush it doesn't call the underlying ResponseWriter's Flush. It's a no-op if rw
+// is already closed, or if nothing has been written to it yet. This is what
+// Hijack/Push/CloseNotify use: none of them mark the end of the response the way Commit
+// does (Push and CloseNotify are conventionally called before or alongside the main
+// response, not after it), so they don't finalize the buffer the way a full Commit
+// would. Hijack closes the buffer itself afterwards, since the connection is no longer
+// the ResponseWriter's to write to.
+func (rw *ResponseWriterBuffer) flushPending() error {
+	if rw.closed || !rw.hasPendingOutput() {
+		return nil
+	}
+	_, err := rw.flushBody()
+	return err
+}
+
+// doFlush sends whatever's been buffered since the last Flush to the underlying
+// ResponseWriter and asks it to flush, if it can, without closing the buffer — so a
+// streaming handler can keep calling Write and Flush for as many chunks as it needs.
+// Errors from the flush are discarded, matching the http.Flusher contract, which has no
+// error return.
+func (rw *ResponseWriterBuffer) doFlush() {
+	if rw.closed {
+		return
+	}
+	rw.flushBody()
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// doHijack hijacks the underlying connection, per http.Hijacker. If the handler has
+// already written a status code or body, or set trailers, the header and body are
+// flushed first so they aren't lost (buffered trailer values themselves are not
+// written); but a writer that's had nothing written to it is handed over as-is,
+// without implicitly committing an empty "200 OK" response ahead of the raw bytes the
+// caller is about to take over writing, which would otherwise corrupt protocol
+// upgrades (websockets, SSE) relying on Hijack.
+func (rw *ResponseWriterBuffer) doHijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	if err := rw.flushPending(); err != nil {
+		return nil, nil, err
+	}
+	rw.closed = true
+	return hj.Hijack()
+}
+
+// doPush flushes any output already buffered, so it isn't lost, and then delegates to
+// the underlying ResponseWriter's Push, per http.Pusher. It doesn't close the buffer:
+// Push is conventionally called before the main response is written, so the push
+// promise precedes it, and the handler is expected to keep writing its own response
+// afterwards.
+func (rw *ResponseWriterBuffer) doPush(target string, opts *http.PushOptions) error {
+	if err := rw.flushPending(); err != nil {
+		return err
+	}
+	p, ok := rw.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
+
+// doCloseNotify flushes any output already buffered, so it isn't lost, and then
+// delegates to the underlying ResponseWriter's CloseNotify, per http.CloseNotifier. It
+// doesn't close the buffer: CloseNotify is conventionally called at the start of a
+// handler, before anything's been written, to watch for client disconnects while the
+// handler is still producing its response.
+func (rw *ResponseWriterBuffer) doCloseNotify() <-chan bool {
+	rw.flushPending()
+	cn, ok := rw.ResponseWriter.(http.CloseNotifier)
+	if !ok {
+		return make(chan bool)
+	}
+	return cn.CloseNotify()
+}
+
+// The following types pair *ResponseWriterBuffer with exactly the subset of
+// http.Flusher, http.Hijacker, http.Pusher, and http.CloseNotifier that the wrapped
+// ResponseWriter satisfies. New picks the right one so that type assertions performed by
+// middleware further down the chain (e.g. `if hj, ok := w.(http.Hijacker); ok`) see the
+// same answer they would've seen against the original ResponseWriter. This mirrors the
+// capability-probing approach used by well-known ResponseWriter wrapping middleware.
+
+type flusherWriter struct{ *ResponseWriterBuffer }
+
+func (w flusherWriter) Flush() { w.doFlush() }
+
+type hijackerWriter struct{ *ResponseWriterBuffer }
+
+func (w hijackerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return w.doHijack() }
+
+type pusherWriter struct{ *ResponseWriterBuffer }
+
+func (w pusherWriter) Push(target string, opts *http.PushOptions) error {
+	return w.doPush(target, opts)
+}
+
+type closeNotifierWriter struct{ *ResponseWriterBuffer }
+
+func (w closeNotifierWriter) CloseNotify() <-chan bool { return w.doCloseNotify() }
+
+type flusherHijackerWriter struct{ *ResponseWriterBuffer }
+
+func (w flusherHijackerWriter) Flush() { w.doFlush() }
+func (w flusherHijackerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.doHijack()
+}
+
+type flusherPusherWriter struct{ *ResponseWriterBuffer }
+
+func (w flusherPusherWriter) Flush() { w.doFlush() }
+func (w flusherPusherWriter) Push(target string, opts *http.PushOptions) error {
+	return w.doPush(target, opts)
+}
+
+type flusherCloseNotifierWriter struct{ *ResponseWriterBuffer }
+
+func (w flusherCloseNotifierWriter) Flush()                   { w.doFlush() }
+func (w flusherCloseNotifierWriter) CloseNotify() <-chan bool { return w.doCloseNotify() }
+
+type hijackerPusherWriter struct{ *ResponseWriterBuffer }
+
+func (w hijackerPusherWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.doHijack()
+}
+func (w hijackerPusherWriter) Push(target string, opts *http.PushOptions) error {
+	return w.doPush(target, opts)
+}
+
+type hijackerCloseNotifierWriter struct{ *ResponseWriterBuffer }
+
+func (w hijackerCloseNotifierWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.doHijack()
+}
+func (w hijackerCloseNotifierWriter) CloseNotify() <-chan bool { return w.doCloseNotify() }
+
+type pusherCloseNotifierWriter struct{ *ResponseWriterBuffer }
+
+func (w pusherCloseNotifierWriter) Push(target string, opts *http.PushOptions) error {
+	return w.doPush(target, opts)
+}
+func (w pusherCloseNotifierWriter) CloseNotify() <-chan bool { return w.doCloseNotify() }
+
+type flusherHijackerPusherWriter struct{ *ResponseWriterBuffer }
+
+func (w flusherHijackerPusherWriter) Flush() { w.doFlush() }
+func (w flusherHijackerPusherWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.doHijack()
+}
+func (w flusherHijackerPusherWriter) Push(target string, opts *http.PushOptions) error {
+	return w.doPush(target, opts)
+}
+
+type flusherHijackerCloseNotifierWriter struct{ *ResponseWriterBuffer }
+
+func (w flusherHijackerCloseNotifierWriter) Flush() { w.doFlush() }
+func (w flusherHijackerCloseNotifierWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.doHijack()
+}
+func (w flusherHijackerCloseNotifierWriter) CloseNotify() <-chan bool { return w.doCloseNotify() }
+
+type flusherPusherCloseNotifierWriter struct{ *ResponseWriterBuffer }
+
+func (w flusherPusherCloseNotifierWriter) Flush() { w.doFlush() }
+func (w flusherPusherCloseNotifierWriter) Push(target string, opts *http.PushOptions) error {
+	return w.doPush(target, opts)
+}
+func (w flusherPusherCloseNotifierWriter) CloseNotify() <-chan bool { return w.doCloseNotify() }
+
+type hijackerPusherCloseNotifierWriter struct{ *ResponseWriterBuffer }
+
+func (w hijackerPusherCloseNotifierWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.doHijack()
+}
+func (w hijackerPusherCloseNotifierWriter) Push(target string, opts *http.PushOptions) error {
+	return w.doPush(target, opts)
+}
+func (w hijackerPusherCloseNotifierWriter) CloseNotify() <-chan bool { return w.doCloseNotify() }
+
+type flusherHijackerPusherCloseNotifierWriter struct{ *ResponseWriterBuffer }
+
+func (w flusherHijackerPusherCloseNotifierWriter) Flush() { w.doFlush() }
+func (w flusherHijackerPusherCloseNotifierWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.doHijack()
+}
+func (w flusherHijackerPusherCloseNotifierWriter) Push(target string, opts *http.PushOptions) error {
+	return w.doPush(target, opts)
+}
+func (w flusherHijackerPusherCloseNotifierWriter) CloseNotify() <-chan bool {
+	return w.doCloseNotify()
+}
+
+// bufferUnwrapper is satisfied by every value returned from New, letting callers recover
+// the underlying *ResponseWriterBuffer regardless of which capability interfaces that
+// value ended up satisfying.
+type bufferUnwrapper interface {
+	Unwrap() *ResponseWriterBuffer
+}
+
+// Unwrap returns the *ResponseWriterBuffer backing a value returned from New, so that
+// rwb-specific methods like Commit, Body, and StatusCode stay reachable no matter which
+// capability-specific type New picked for w.
+func Unwrap(w http.ResponseWriter) (*ResponseWriterBuffer, bool) {
+	u, ok := w.(bufferUnwrapper)
+	if !ok {
+		return nil, false
+	}
+	return u.Unwrap(), true
+}
+
+// New creates a buffer for the provided ResponseWriter, applying any options given, and
+// returns it wrapped in exactly the combination of http.Flusher, http.Hijacker,
+// http.Pusher, and http.CloseNotifier that w itself satisfies. Use the package-level
+// Unwrap to recover the *ResponseWriterBuffer for access to its other methods.
+func New(w http.ResponseWriter, opts ...Option) http.ResponseWriter {
+	rw := newBuffer(w, opts...)
+
+	_, f := w.(http.Flusher)
+	_, h := w.(http.Hijacker)
+	_, p := w.(http.Pusher)
+	_, c := w.(http.CloseNotifier)
+
+	switch {
+	case f && h && p && c:
+		return flusherHijackerPusherCloseNotifierWriter{rw}
+	case f && h && p:
+		return flusherHijackerPusherWriter{rw}
+	case f && h && c:
+		return flusherHijackerCloseNotifierWriter{rw}
+	case f && p && c:
+		return flusherPusherCloseNotifierWriter{rw}
+	case h && p && c:
+		return hijackerPusherCloseNotifierWriter{rw}
+	case f && h:
+		return flusherHijackerWriter{rw}
+	case f && p:
+		return flusherPusherWriter{rw}
+	case f && c:
+		return flusherCloseNotifierWriter{rw}
+	case h && p:
+		return hijackerPusherWriter{rw}
+	case h && c:
+		return hijackerCloseNotifierWriter{rw}
+	case p && c:
+		return pusherCloseNotifierWriter{rw}
+	case f:
+		return flusherWriter{rw}
+	case h:
+		return hijackerWriter{rw}
+	case p:
+		return pusherWriter{rw}
+	case c:
+		return closeNotifierWriter{rw}
+	default:
+		return rw
+	}
+}
+
+// newBuffer builds the underlying *ResponseWriterBuffer without any capability
+// wrapping, for use by New and by package internals (e.g. Middleware) that need direct
+// access to its methods before handing a properly-wrapped writer down the chain.
+func newBuffer(w http.ResponseWriter, opts ...Option) *ResponseWriterBuffer {
+	rw := &ResponseWriterBuffer{
+		ResponseWriter: w,
+		header:         w.Header().Clone(),
+		body:           bytes.Buffer{},
+		statusCode:     0,
+	}
+	for _, opt := range opts {
+		opt(rw)
+	}
+	return rw
+}
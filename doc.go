@@ -32,14 +32,15 @@ func main() {
 		// New header exists.
 		log.Println(w.Header().Get("Content-Type"))
 
-		// Or you could write to the buffer, and flush it when you're done.
+		// Or you could write to the buffer, and commit it when you're done.
 		writerBuf := rwb.New(w)
 		writerBuf.Header().Set("potato", "russet")
 
 		// New header doesn't exist yet. It's in the buffer!
 		log.Println(w.Header().Get("potato"))
 
-		_, err := writerBuf.Flush()
+		buf, _ := rwb.Unwrap(writerBuf)
+		_, err := buf.Commit()
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,269 @@
+/**
+ * middleware.go
+ *
+ * Copyright (c) 2021 Forest Hoffman. All Rights Reserved.
+ * License: MIT License (see the included LICENSE file) or download at
+ *     https://raw.githubusercontent.com/foresthoffman/rwb/master/LICENSE
+ */
+
+package rwb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// supportedEncodings lists the content codings compressBody knows how to apply. Brotli
+// ("br") is deliberately not included: there's no implementation in the standard
+// library, and offering it without one would mean accepting it happily in
+// WithCompression only to fail deep in the request path the first time a client
+// actually negotiates it.
+var supportedEncodings = map[string]bool{
+	"gzip":    true,
+	"deflate": true,
+}
+
+// WithCompression enables transparent response compression. Once the handler's full
+// response is buffered, it's gzip- or deflate-encoded according to the request's
+// Accept-Encoding header, whichever the client and encodings both allow, tried in the
+// given order. If no encodings are given, gzip and deflate are offered, in that order.
+//
+// Any encoding compressBody can't actually produce (e.g. "br", which has no standard
+// library implementation) is dropped here, with a warning logged, rather than being
+// offered to clients and failing the request the first time one negotiates it.
+func WithCompression(encodings ...string) Option {
+	if len(encodings) == 0 {
+		encodings = []string{"gzip", "deflate"}
+	}
+	supported := encodings[:0:0]
+	for _, encoding := range encodings {
+		if !supportedEncodings[encoding] {
+			log.Printf("rwb: WithCompression: unsupported encoding %q dropped", encoding)
+			continue
+		}
+		supported = append(supported, encoding)
+	}
+	return func(rw *ResponseWriterBuffer) {
+		rw.compressionPrefs = supported
+	}
+}
+
+// WithETag computes a strong ETag (a SHA-256 hash of the buffered body) and sets it on
+// 200 OK responses before Commit.
+func WithETag() Option {
+	return func(rw *ResponseWriterBuffer) {
+		rw.wantETag = true
+	}
+}
+
+// WithConditional rewrites a buffered 200 response into a 304 Not Modified with an
+// empty body when the request's If-None-Match or If-Modified-Since indicates the
+// client's cached copy is still fresh. It implies WithETag, since If-None-Match is
+// checked against the buffered body's computed ETag.
+func WithConditional() Option {
+	return func(rw *ResponseWriterBuffer) {
+		rw.wantETag = true
+		rw.wantConditional = true
+	}
+}
+
+// withRequest carries the parts of the incoming request that postProcess needs to
+// negotiate encoding and evaluate conditional headers. Middleware attaches it; it's not
+// meant to be set directly by callers of New.
+func withRequest(r *http.Request) Option {
+	return func(rw *ResponseWriterBuffer) {
+		rw.acceptEncoding = r.Header.Get("Accept-Encoding")
+		rw.ifNoneMatch = r.Header.Get("If-None-Match")
+		rw.ifModifiedSince = r.Header.Get("If-Modified-Since")
+	}
+}
+
+// postProcess applies the ETag, conditional-request, and compression options to the
+// buffered response, in that order, before Commit writes it to the underlying
+// ResponseWriter.
+func (rw *ResponseWriterBuffer) postProcess() error {
+	if !rw.wantETag && !rw.wantConditional && len(rw.compressionPrefs) == 0 {
+		return nil
+	}
+
+	if rw.headerSent {
+		// The response has already been sent to the client, in part or in full, by an
+		// earlier Flush. Rewriting the status/headers or re-encoding the body at this
+		// point would just corrupt what's already gone out on the wire, so the best
+		// this can do is leave the rest of the stream alone and say why.
+		log.Print("rwb: postProcess: skipping ETag/conditional/compression on a response that was already flushed mid-stream")
+		return nil
+	}
+
+	if rw.wantETag && rw.StatusCode() == http.StatusOK {
+		sum := sha256.Sum256(rw.Body())
+		rw.header.Set("ETag", fmt.Sprintf(`"%x"`, sum))
+	}
+
+	if rw.wantConditional && rw.StatusCode() == http.StatusOK && rw.notModified() {
+		rw.statusCode = http.StatusNotModified
+		rw.wroteHeader = true
+		rw.header.Del("Content-Type")
+		rw.header.Del("Content-Encoding")
+		rw.setBody(nil)
+		return nil
+	}
+
+	if encoding, ok := rw.negotiateEncoding(); ok {
+		if body := rw.Body(); len(body) > 0 {
+			compressed, err := compressBody(encoding, body)
+			if err != nil {
+				return err
+			}
+			rw.header.Set("Content-Encoding", encoding)
+			rw.header.Add("Vary", "Accept-Encoding")
+			rw.setBody(compressed)
+		}
+	}
+
+	rw.header.Set("Content-Length", strconv.Itoa(len(rw.Body())))
+	return nil
+}
+
+// notModified reports whether the request's conditional headers show the client's
+// cached copy is still fresh, per the buffered response's ETag and Last-Modified header.
+func (rw *ResponseWriterBuffer) notModified() bool {
+	if rw.ifNoneMatch != "" {
+		etag := rw.header.Get("ETag")
+		for _, candidate := range strings.Split(rw.ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || (etag != "" && candidate == etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if rw.ifModifiedSince != "" {
+		lastModified := rw.header.Get("Last-Modified")
+		if lastModified == "" {
+			return false
+		}
+		since, err := http.ParseTime(rw.ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(lastModified)
+		if err != nil {
+			return false
+		}
+		return !modified.After(since)
+	}
+	return false
+}
+
+// negotiateEncoding picks the first of rw.compressionPrefs that the request's
+// Accept-Encoding header allows.
+func (rw *ResponseWriterBuffer) negotiateEncoding() (string, bool) {
+	if len(rw.compressionPrefs) == 0 || rw.acceptEncoding == "" {
+		return "", false
+	}
+	accepted := parseAcceptEncoding(rw.acceptEncoding)
+	for _, encoding := range rw.compressionPrefs {
+		if q, ok := accepted[encoding]; ok && q > 0 {
+			return encoding, true
+		}
+	}
+	if q, ok := accepted["*"]; ok && q > 0 {
+		// The wildcard only covers encodings the client didn't mention explicitly;
+		// one given an explicit q=0 has been expressly ruled out and must still be
+		// skipped here.
+		for _, encoding := range rw.compressionPrefs {
+			if q, explicit := accepted[encoding]; explicit && q <= 0 {
+				continue
+			}
+			return encoding, true
+		}
+	}
+	return "", false
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header into a map of encoding name to
+// its q-value (defaulting to 1 when unspecified).
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.TrimSpace(fields[0])
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	return accepted
+}
+
+// compressBody encodes body using the named content coding.
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w interface {
+		io.WriteCloser
+	}
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	default:
+		return nil, fmt.Errorf("rwb: unsupported compression encoding %q", encoding)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Middleware wraps next so that its response is buffered, post-processed according to
+// opts (ETag, conditional requests, compression), and only then committed to the real
+// ResponseWriter. If next hijacks the connection or flushes mid response, that happens
+// immediately against the underlying ResponseWriter instead, and post-processing is
+// skipped for that response. Pushing a resource skips post-processing only if next had
+// already written something before the push, since that output is sent ahead of it.
+func Middleware(next http.Handler, opts ...Option) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqOpts := make([]Option, len(opts)+1)
+		copy(reqOpts, opts)
+		reqOpts[len(opts)] = withRequest(r)
+
+		wrapped := New(w, reqOpts...)
+		next.ServeHTTP(wrapped, r)
+
+		if rw, ok := Unwrap(wrapped); ok {
+			if _, err := rw.Commit(); err != nil && err != ErrBufferClosed {
+				// The buffer's already been through postProcess and is sitting fully
+				// formed in memory at this point, so there's nothing left to recover
+				// the response with; log it so the failure is at least visible instead
+				// of the client silently receiving an empty response.
+				log.Printf("rwb: Middleware: commit failed: %v", err)
+			}
+		}
+	})
+}
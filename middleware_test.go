@@ -0,0 +1,242 @@
+/**
+ * middleware_test.go
+ *
+ * Copyright (c) 2021 Forest Hoffman. All Rights Reserved.
+ * License: MIT License (see the included LICENSE file) or download at
+ *     https://raw.githubusercontent.com/foresthoffman/rwb/master/LICENSE
+ */
+
+package rwb
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware_Compression(t *testing.T) {
+	body := []byte("hello hello hello hello hello hello hello hello hello hello")
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}), WithCompression())
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if got := res.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("expected: %q got: %q", "gzip", got)
+	}
+
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(got) != string(body) {
+		t.Errorf("expected: %q got: %q", string(body), string(got))
+	}
+}
+
+func TestMiddleware_UnsupportedCompressionEncodingIgnored(t *testing.T) {
+	body := []byte("hello")
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}), WithCompression("br", "gzip"))
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "br, gzip")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	// "br" was dropped at configuration time, so gzip should be negotiated instead of
+	// the request failing deep in the response path.
+	if got := res.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("expected: %q got: %q", "gzip", got)
+	}
+
+	gz, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(got) != string(body) {
+		t.Errorf("expected: %q got: %q", string(body), string(got))
+	}
+}
+
+func TestMiddleware_CompressionSkippedAfterMidStreamFlush(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("chunk1 "))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("chunk2"))
+	}), WithCompression())
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	// postProcess can't compress a response that's already partly gone out on the
+	// wire, so it has to back off entirely rather than produce a body that's raw
+	// bytes followed by a gzip stream of the same data.
+	if got := res.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("expected no Content-Encoding, got: %q", got)
+	}
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(got) != "chunk1 chunk2" {
+		t.Errorf("expected: %q got: %q", "chunk1 chunk2", string(got))
+	}
+}
+
+func TestMiddleware_NoCompressionWithoutAcceptEncoding(t *testing.T) {
+	body := []byte("hello")
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}), WithCompression())
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// The default transport adds "Accept-Encoding: gzip" on its own and decodes the
+	// response transparently, so it's turned off here to send no Accept-Encoding at all.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	res, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if got := res.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("expected no Content-Encoding, got: %q", got)
+	}
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(got) != string(body) {
+		t.Errorf("expected: %q got: %q", string(body), string(got))
+	}
+}
+
+func TestNegotiateEncoding_WildcardHonorsExplicitRejection(t *testing.T) {
+	rwb := newBuffer(httptest.NewRecorder())
+	rwb.compressionPrefs = []string{"gzip", "deflate"}
+	rwb.acceptEncoding = "gzip;q=0, *;q=1"
+
+	encoding, ok := rwb.negotiateEncoding()
+	if !ok {
+		t.Fatal("expected an encoding to be negotiated via the wildcard")
+	}
+	// gzip was explicitly rejected with q=0; the wildcard only covers encodings the
+	// client didn't mention by name, so deflate should be picked instead.
+	if encoding != "deflate" {
+		t.Errorf("expected: %q got: %q", "deflate", encoding)
+	}
+}
+
+func TestMiddleware_ETag(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}), WithETag())
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if got := res.Header.Get("ETag"); got == "" {
+		t.Error("expected an ETag header")
+	}
+}
+
+func TestMiddleware_Conditional(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}), WithConditional())
+
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := res.Header.Get("ETag")
+	res.Body.Close()
+	if etag == "" {
+		t.Fatal("expected an ETag header on the first response")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", etag)
+
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("expected: %d got: %d", http.StatusNotModified, res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(body) != 0 {
+		t.Errorf("expected an empty body, got: %q", string(body))
+	}
+}
@@ -11,11 +11,57 @@ package rwb
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"os"
+	"runtime"
 )
 
 var ErrBufferClosed = errors.New("buffer closed")
 
+// ErrBufferOverflow is returned by Write when MaxBufferSize has been set with
+// ErrorOnOverflow, and the buffered body would exceed that size.
+var ErrBufferOverflow = errors.New("buffer overflow")
+
+// BufferOverflowPolicy determines what a ResponseWriterBuffer does when a Write would
+// cause the buffered body to exceed MaxBufferSize.
+type BufferOverflowPolicy int
+
+const (
+	// ErrorOnOverflow causes Write to return ErrBufferOverflow instead of buffering any
+	// bytes beyond MaxBufferSize.
+	ErrorOnOverflow BufferOverflowPolicy = iota
+
+	// SpillToDisk causes the buffer to transparently move the buffered body to a
+	// temporary file on disk once MaxBufferSize would otherwise be exceeded, so that
+	// large responses don't have to be held in memory.
+	SpillToDisk
+)
+
+// Option configures optional behavior on a ResponseWriterBuffer. Options are applied by
+// New in the order they're given.
+type Option func(*ResponseWriterBuffer)
+
+// MaxBufferSize caps the in-memory body buffer at n bytes. Once a Write would cause the
+// buffer to exceed n, policy determines whether the write is rejected with
+// ErrBufferOverflow, or the buffer spills over to a temporary file on disk.
+func MaxBufferSize(n int64, policy BufferOverflowPolicy) Option {
+	return func(rw *ResponseWriterBuffer) {
+		rw.maxBufferSize = n
+		rw.overflowPolicy = policy
+	}
+}
+
+// writerFunc adapts a function to the io.Writer interface, mirroring http.HandlerFunc.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
 // ResponseWriterBuffer simulates the functionality of the underlying ResponseWriter
 // without sending headers or body bytes to the actual requesting client. Upon flushing
 // the ResponseWriterBuffer, all captured header and body information is written to the
@@ -25,10 +71,30 @@ var ErrBufferClosed = errors.New("buffer closed")
 // response to the requesting client.
 type ResponseWriterBuffer struct {
 	http.ResponseWriter
-	header     http.Header
-	body       bytes.Buffer
-	statusCode int
-	closed     bool
+	header      http.Header
+	body        bytes.Buffer
+	statusCode  int
+	wroteHeader bool
+	closed      bool
+
+	// headerSent and flushed track how much of the buffered response has already been
+	// written to the underlying ResponseWriter by a prior Flush, so that a later Flush
+	// or the final Commit only sends what's new instead of re-sending the whole buffer.
+	headerSent bool
+	flushed    int
+
+	trailers http.Header
+
+	maxBufferSize  int64
+	overflowPolicy BufferOverflowPolicy
+	overflow       *os.File
+
+	compressionPrefs []string
+	wantETag         bool
+	wantConditional  bool
+	acceptEncoding   string
+	ifNoneMatch      string
+	ifModifiedSince  string
 }
 
 // Header returns a copy of the ResponseWriter header map. It should be assumed that this
@@ -37,67 +103,257 @@ func (rw *ResponseWriterBuffer) Header() http.Header {
 	return rw.header
 }
 
-// Write sends the provided bytes to a buffer instead of the requesting client.
+// Write appends the provided bytes to the buffer instead of sending them to the
+// requesting client. Unlike a single-shot write, calling Write repeatedly accumulates
+// bytes onto the existing buffer, matching the http.ResponseWriter contract relied on by
+// things like json.Encoder and io.Copy.
 func (rw *ResponseWriterBuffer) Write(body []byte) (int, error) {
 	if rw.closed {
 		return 0, ErrBufferClosed
 	}
-	rw.body.Reset()
-	return rw.body.Write(body)
+	return rw.write(body)
 }
 
-// WriteHeader stores a copy of the desired ResponseWriter header status code.
-func (rw *ResponseWriterBuffer) WriteHeader(statusCode int) {
-	rw.statusCode = statusCode
+// write performs the actual buffering, enforcing maxBufferSize and spilling to disk if
+// configured to do so. It's shared by Write and ReadFrom.
+func (rw *ResponseWriterBuffer) write(p []byte) (int, error) {
+	if rw.overflow != nil {
+		return rw.overflow.Write(p)
+	}
+	if rw.maxBufferSize > 0 && int64(rw.body.Len()+len(p)) > rw.maxBufferSize {
+		if rw.overflowPolicy == ErrorOnOverflow {
+			return 0, ErrBufferOverflow
+		}
+		if err := rw.spill(); err != nil {
+			return 0, err
+		}
+		return rw.overflow.Write(p)
+	}
+	return rw.body.Write(p)
+}
+
+// spill moves the in-memory buffer to a temporary file on disk, so that future writes no
+// longer count against the in-memory MaxBufferSize limit.
+func (rw *ResponseWriterBuffer) spill() error {
+	f, err := ioutil.TempFile("", "rwb-*.tmp")
+	if err != nil {
+		return err
+	}
+	if rw.body.Len() > 0 {
+		if _, err := f.Write(rw.body.Bytes()); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		rw.body.Reset()
+	}
+	rw.overflow = f
+	return nil
 }
 
-// Flush takes all the buffered header and body values, and writes them to the underlying
-// ResponseWriter. Returns the number of bytes written and any error.
-func (rw *ResponseWriterBuffer) Flush() (int, error) {
+// ReadFrom reads from r until EOF, buffering the bytes read the same way Write does. It
+// satisfies io.ReaderFrom so that io.Copy(rwb, src) can stream into the buffer. When no
+// MaxBufferSize is set, it reads straight into the in-memory buffer without an
+// intermediate allocation; otherwise it copies through io.Copy's own buffer.
+func (rw *ResponseWriterBuffer) ReadFrom(r io.Reader) (int64, error) {
 	if rw.closed {
 		return 0, ErrBufferClosed
 	}
-	// Remove keys that were deleted from the clone.
-	actualHeader := rw.ResponseWriter.Header()
-	for key := range actualHeader {
-		if _, ok := rw.header[key]; !ok {
-			actualHeader.Del(key)
+	if rw.overflow != nil {
+		return io.Copy(rw.overflow, r)
+	}
+	if rw.maxBufferSize <= 0 {
+		return rw.body.ReadFrom(r)
+	}
+	return io.Copy(writerFunc(rw.write), r)
+}
+
+// WriteHeader stores a copy of the desired ResponseWriter header status code. As with the
+// standard net/http server, only the first call has any effect; subsequent calls are
+// ignored and logged as superfluous.
+func (rw *ResponseWriterBuffer) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		logSuperfluousWriteHeader()
+		return
+	}
+	rw.wroteHeader = true
+	rw.statusCode = statusCode
+}
+
+// logSuperfluousWriteHeader logs a warning for a WriteHeader call that's been ignored
+// because the status code was already set, mirroring the "superfluous
+// response.WriteHeader call" warning logged by the standard net/http server.
+func logSuperfluousWriteHeader() {
+	if _, file, line, ok := runtime.Caller(2); ok {
+		log.Printf("rwb: superfluous WriteHeader call from %s:%d", file, line)
+		return
+	}
+	log.Print("rwb: superfluous WriteHeader call")
+}
+
+// SetTrailer buffers a trailer key/value pair to be written after the body on Commit, and
+// announces key in the response's Trailer header if it hasn't been already. As with the
+// standard net/http server, trailers are only delivered to clients that negotiate chunked
+// transfer encoding or HTTP/2, such as gRPC-Web clients.
+func (rw *ResponseWriterBuffer) SetTrailer(key, value string) {
+	key = http.CanonicalHeaderKey(key)
+	if rw.trailers == nil {
+		rw.trailers = make(http.Header)
+	}
+	rw.trailers.Add(key, value)
+
+	for _, name := range rw.header.Values("Trailer") {
+		if http.CanonicalHeaderKey(name) == key {
+			return
 		}
 	}
-	// Copy new header values from the clone.
-	for key, values := range rw.header {
-		for _, value := range values {
-			found := false
-			for _, actualValue := range actualHeader.Values(key) {
-				if actualValue == value {
-					found = true
-					break
-				}
-			}
-			if found {
-				continue
-			}
-			actualHeader.Add(key, value)
+	rw.header.Add("Trailer", key)
+}
+
+// StatusCode returns the status code that has been buffered so far. If WriteHeader
+// hasn't been called yet, this returns http.StatusOK, matching the default behavior of
+// the standard net/http server.
+func (rw *ResponseWriterBuffer) StatusCode() int {
+	if rw.statusCode == 0 {
+		return http.StatusOK
+	}
+	return rw.statusCode
+}
+
+// Body returns the bytes currently buffered for the response body. If the buffer has
+// spilled to disk, this reads the spilled file back into memory.
+func (rw *ResponseWriterBuffer) Body() []byte {
+	if rw.overflow != nil {
+		if _, err := rw.overflow.Seek(0, io.SeekStart); err != nil {
+			return nil
+		}
+		b, err := ioutil.ReadAll(rw.overflow)
+		if err != nil {
+			return nil
 		}
+		return b
 	}
+	return rw.body.Bytes()
+}
+
+// setBody replaces the buffered body wholesale, discarding any spilled file. Used by
+// post-processing steps (compression, conditional-request rewriting) that need to
+// substitute a transformed body for the one the handler wrote.
+func (rw *ResponseWriterBuffer) setBody(b []byte) {
+	if rw.overflow != nil {
+		rw.overflow.Close()
+		os.Remove(rw.overflow.Name())
+		rw.overflow = nil
+	}
+	rw.body.Reset()
+	rw.body.Write(b)
+	// The body has been replaced wholesale, so anything flushed against the old one no
+	// longer applies.
+	rw.flushed = 0
+}
 
-	if rw.statusCode != 0 {
-		rw.ResponseWriter.WriteHeader(rw.statusCode)
+// hasPendingOutput reports whether anything has actually been buffered for this
+// response yet, as opposed to a writer that's been created but never written to. It's
+// used to decide whether Hijack needs to commit a response before taking over the
+// connection, or can hand it over as-is.
+func (rw *ResponseWriterBuffer) hasPendingOutput() bool {
+	return rw.wroteHeader || rw.body.Len() > 0 || rw.overflow != nil || len(rw.trailers) > 0
+}
+
+// Result returns the buffered response as an *http.Response, modelled on
+// httptest.ResponseRecorder.Result(). This lets middleware inspect the status, headers,
+// and body a handler produced before the buffer is committed to the underlying
+// ResponseWriter.
+func (rw *ResponseWriterBuffer) Result() *http.Response {
+	statusCode := rw.StatusCode()
+	body := rw.Body()
+	res := &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rw.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
 	}
-	n, err := rw.ResponseWriter.Write(rw.body.Bytes())
+	return res
+}
+
+// Commit takes all the buffered header and body values, and writes them to the
+// underlying ResponseWriter. Returns the number of bytes written and any error.
+//
+// Commit was named Flush prior to introducing real http.Flusher support; Flush is now
+// reserved, on the capability-specific writers returned by New, for draining the buffer
+// and delegating to the underlying ResponseWriter's own Flush. Call Commit directly when
+// you need the byte count or error that Flush's signature has no room for.
+func (rw *ResponseWriterBuffer) Commit() (int, error) {
+	if rw.closed {
+		return 0, ErrBufferClosed
+	}
+	if err := rw.postProcess(); err != nil {
+		return 0, err
+	}
+	n, err := rw.flushBody()
 	if err != nil {
 		return 0, err
 	}
+	// Trailers are only picked up by the standard net/http server once they're set on the
+	// ResponseWriter's header after the body has been written, per the http.Trailer
+	// convention, so this has to happen last.
+	for key, values := range rw.trailers {
+		for _, value := range values {
+			rw.ResponseWriter.Header().Add(key, value)
+		}
+	}
+	if rw.overflow != nil {
+		rw.overflow.Close()
+		os.Remove(rw.overflow.Name())
+		rw.overflow = nil
+	}
 	rw.closed = true
 	return n, nil
 }
 
-// New creates a buffer for the provided ResponseWriter.
-func New(w http.ResponseWriter) *ResponseWriterBuffer {
-	return &ResponseWriterBuffer{
-		ResponseWriter: w,
-		header:         w.Header().Clone(),
-		body:           bytes.Buffer{},
-		statusCode:     0,
+// flushBody sends the header, if it hasn't been sent yet, and whatever body bytes have
+// been buffered since the last flushBody call, to the underlying ResponseWriter. Unlike
+// Commit, it doesn't close the buffer, so Write can be called again afterwards and a
+// later flushBody call only sends what's new — this is what lets a streaming handler
+// interleave Write and Flush across many chunks instead of being limited to a single
+// flush.
+func (rw *ResponseWriterBuffer) flushBody() (int, error) {
+	if !rw.headerSent {
+		// Replace the underlying header wholesale with the buffered one, so that
+		// deletions and overwrites made against the buffer are reflected exactly,
+		// rather than merged additively with whatever was there before New was called.
+		actualHeader := rw.ResponseWriter.Header()
+		for key := range actualHeader {
+			delete(actualHeader, key)
+		}
+		for key, values := range rw.header {
+			actualHeader[key] = values
+		}
+		if rw.wroteHeader {
+			rw.ResponseWriter.WriteHeader(rw.statusCode)
+		}
+		rw.headerSent = true
 	}
+
+	body := rw.Body()
+	if rw.flushed >= len(body) {
+		return 0, nil
+	}
+	n, err := rw.ResponseWriter.Write(body[rw.flushed:])
+	rw.flushed += n
+	if err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// Unwrap returns rw itself. It exists so that the capability-specific values returned by
+// New can be unwrapped back down to the underlying *ResponseWriterBuffer via the
+// package-level Unwrap function, regardless of which of those values New handed back.
+func (rw *ResponseWriterBuffer) Unwrap() *ResponseWriterBuffer {
+	return rw
 }
@@ -9,9 +9,13 @@
 package rwb
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -39,7 +43,7 @@ func TestResponseWriterBuffer_Write(t *testing.T) {
 	for _, testCase := range writeTestCases {
 		t.Run(testCase.Name, func(t *testing.T) {
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				rwb := New(w)
+				rwb, _ := Unwrap(New(w))
 				// Writing to ResponseWriterBuffer.
 				n, err := rwb.Write(testCase.ResponseBody)
 				if err != nil {
@@ -50,7 +54,7 @@ func TestResponseWriterBuffer_Write(t *testing.T) {
 				}
 				if testCase.Flush {
 					// Send the buffered data to the ResponseWriter.
-					n, err := rwb.Flush()
+					n, err := rwb.Commit()
 					if err != nil {
 						t.Error(err)
 					}
@@ -166,6 +170,168 @@ var (
 	}
 )
 
+func TestResponseWriterBuffer_WriteMultipleChunks(t *testing.T) {
+	chunks := [][]byte{
+		[]byte("hello "),
+		[]byte("123"),
+		[]byte(" goodbye"),
+	}
+	expected := bytes.Join(chunks, nil)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rwb, _ := Unwrap(New(w))
+		for _, chunk := range chunks {
+			n, err := rwb.Write(chunk)
+			if err != nil {
+				t.Error(err)
+			}
+			if n != len(chunk) {
+				t.Errorf("expected: %d got: %d", len(chunk), n)
+			}
+		}
+		if _, err := rwb.Commit(); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Error(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	if string(b) != string(expected) {
+		t.Errorf("expected: %q got: %q", string(expected), string(b))
+	}
+}
+
+func TestResponseWriterBuffer_ReadFrom(t *testing.T) {
+	src := bytes.NewBufferString("hello 123 goodbye")
+	expected := src.Bytes()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrapped := New(w)
+		// bytes.Reader's WriteTo is hidden so that io.Copy goes through ReadFrom rather
+		// than calling Write directly.
+		n, err := io.Copy(wrapped, struct{ io.Reader }{bytes.NewReader(expected)})
+		if err != nil {
+			t.Error(err)
+		}
+		if n != int64(len(expected)) {
+			t.Errorf("expected: %d got: %d", len(expected), n)
+		}
+		rwb, _ := Unwrap(wrapped)
+		if _, err := rwb.Commit(); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Error(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	if string(b) != string(expected) {
+		t.Errorf("expected: %q got: %q", string(expected), string(b))
+	}
+}
+
+func TestResponseWriterBuffer_MaxBufferSize(t *testing.T) {
+	t.Run("error_on_overflow", func(t *testing.T) {
+		rwb, _ := Unwrap(New(httptest.NewRecorder(), MaxBufferSize(4, ErrorOnOverflow)))
+		if _, err := rwb.Write([]byte("hello")); err != ErrBufferOverflow {
+			t.Errorf("expected: %v got: %v", ErrBufferOverflow, err)
+		}
+	})
+
+	t.Run("spill_to_disk", func(t *testing.T) {
+		rwb, _ := Unwrap(New(httptest.NewRecorder(), MaxBufferSize(4, SpillToDisk)))
+		if _, err := rwb.Write([]byte("hello")); err != nil {
+			t.Error(err)
+		}
+		if string(rwb.Body()) != "hello" {
+			t.Errorf("expected: %q got: %q", "hello", string(rwb.Body()))
+		}
+		if _, err := rwb.Commit(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+var statusCodeTestCases = []struct {
+	Name               string
+	StatusCode         int
+	WriteHeaderCalled  bool
+	ExpectedStatusCode int
+}{
+	{
+		Name:               "explicit_status_code",
+		StatusCode:         http.StatusCreated,
+		WriteHeaderCalled:  true,
+		ExpectedStatusCode: http.StatusCreated,
+	},
+	{
+		Name:               "default_status_code",
+		WriteHeaderCalled:  false,
+		ExpectedStatusCode: http.StatusOK,
+	},
+}
+
+func TestResponseWriterBuffer_StatusCode(t *testing.T) {
+	for _, testCase := range statusCodeTestCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			rwb, _ := Unwrap(New(httptest.NewRecorder()))
+			if testCase.WriteHeaderCalled {
+				rwb.WriteHeader(testCase.StatusCode)
+			}
+			if rwb.StatusCode() != testCase.ExpectedStatusCode {
+				t.Errorf("expected: %d got: %d", testCase.ExpectedStatusCode, rwb.StatusCode())
+			}
+		})
+	}
+}
+
+func TestResponseWriterBuffer_Result(t *testing.T) {
+	rwb, _ := Unwrap(New(httptest.NewRecorder()))
+	rwb.WriteHeader(http.StatusTeapot)
+	rwb.Header().Set("X-Test", "potato")
+	body := []byte("hello 123")
+	if _, err := rwb.Write(body); err != nil {
+		t.Error(err)
+	}
+
+	res := rwb.Result()
+	if res.StatusCode != http.StatusTeapot {
+		t.Errorf("expected: %d got: %d", http.StatusTeapot, res.StatusCode)
+	}
+	if got := res.Header.Get("X-Test"); got != "potato" {
+		t.Errorf("expected: %q got: %q", "potato", got)
+	}
+	if res.ContentLength != int64(len(body)) {
+		t.Errorf("expected: %d got: %d", len(body), res.ContentLength)
+	}
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(got) != string(body) {
+		t.Errorf("expected: %q got: %q", string(body), string(got))
+	}
+	// Result() only reads the buffer, so the buffered body should still be there afterwards.
+	if rwb.Body() == nil {
+		t.Error("expected buffered body to remain accessible after Result()")
+	}
+}
+
 func TestResponseWriterBuffer_Header(t *testing.T) {
 	for _, testCase := range headerTestCases {
 		t.Run(testCase.Name, func(t *testing.T) {
@@ -176,16 +342,17 @@ func TestResponseWriterBuffer_Header(t *testing.T) {
 						w.Header().Add(key, value)
 					}
 				}
-				rwb := New(w)
+				wrapped := New(w)
 				// Header has some new values.
 				for key, values := range testCase.AdditionalHeaders {
 					for _, value := range values {
-						rwb.Header().Add(key, value)
+						wrapped.Header().Add(key, value)
 					}
 				}
 				if testCase.Flush {
 					// Send the buffered data to the ResponseWriter.
-					_, err := rwb.Flush()
+					rwb, _ := Unwrap(wrapped)
+					_, err := rwb.Commit()
 					if err != nil {
 						t.Error(err)
 					}
@@ -221,3 +388,295 @@ func TestResponseWriterBuffer_Header(t *testing.T) {
 		})
 	}
 }
+
+func TestResponseWriterBuffer_HeaderDeletion(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Header has a value before the ResponseWriterBuffer takes over.
+		w.Header().Set("X-Sandwich", "BLT")
+
+		rwb, _ := Unwrap(New(w))
+		rwb.Header().Del("X-Sandwich")
+		if _, err := rwb.Commit(); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Error(err)
+	}
+	res.Body.Close()
+
+	if got := res.Header.Get("X-Sandwich"); got != "" {
+		t.Errorf("expected header to be deleted, got: %q", got)
+	}
+}
+
+func TestResponseWriterBuffer_HeaderOverwrite(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Header has a value before the ResponseWriterBuffer takes over.
+		w.Header().Set("X-Sandwich", "BLT")
+
+		rwb, _ := Unwrap(New(w))
+		rwb.Header().Set("X-Sandwich", "Reuben")
+		if _, err := rwb.Commit(); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Error(err)
+	}
+	res.Body.Close()
+
+	values := res.Header.Values("X-Sandwich")
+	if len(values) != 1 || values[0] != "Reuben" {
+		t.Errorf("expected: %v got: %v", []string{"Reuben"}, values)
+	}
+}
+
+func TestResponseWriterBuffer_WriteHeaderOnce(t *testing.T) {
+	rwb, _ := Unwrap(New(httptest.NewRecorder()))
+	rwb.WriteHeader(http.StatusCreated)
+	rwb.WriteHeader(http.StatusTeapot)
+
+	if rwb.StatusCode() != http.StatusCreated {
+		t.Errorf("expected: %d got: %d", http.StatusCreated, rwb.StatusCode())
+	}
+}
+
+func TestResponseWriterBuffer_Trailer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rwb, _ := Unwrap(New(w))
+		if _, err := rwb.Write([]byte("hello 123")); err != nil {
+			t.Error(err)
+		}
+		rwb.SetTrailer("X-Checksum", "abc123")
+		if _, err := rwb.Commit(); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Error(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "hello 123" {
+		t.Errorf("expected: %q got: %q", "hello 123", string(body))
+	}
+
+	// Trailers are only populated on the client's response once the body has been fully
+	// read, since they're sent after it on the wire.
+	if got := res.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Errorf("expected: %q got: %q", "abc123", got)
+	}
+}
+
+func TestResponseWriterBuffer_CapabilityProbing(t *testing.T) {
+	t.Run("recorder_only_flusher", func(t *testing.T) {
+		wrapped := New(httptest.NewRecorder())
+		if _, ok := wrapped.(http.Flusher); !ok {
+			t.Error("expected wrapped writer to implement http.Flusher")
+		}
+		if _, ok := wrapped.(http.Hijacker); ok {
+			t.Error("expected wrapped writer to not implement http.Hijacker")
+		}
+	})
+
+	t.Run("server_matches_underlying_capabilities", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, wantFlusher := w.(http.Flusher)
+			_, wantHijacker := w.(http.Hijacker)
+			_, wantPusher := w.(http.Pusher)
+
+			wrapped := New(w)
+			if _, ok := wrapped.(http.Flusher); ok != wantFlusher {
+				t.Errorf("http.Flusher: expected: %v got: %v", wantFlusher, ok)
+			}
+			if _, ok := wrapped.(http.Hijacker); ok != wantHijacker {
+				t.Errorf("http.Hijacker: expected: %v got: %v", wantHijacker, ok)
+			}
+			if _, ok := wrapped.(http.Pusher); ok != wantPusher {
+				t.Errorf("http.Pusher: expected: %v got: %v", wantPusher, ok)
+			}
+			rwb, ok := Unwrap(wrapped)
+			if !ok {
+				t.Error("expected Unwrap to succeed")
+			}
+			if _, err := rwb.Commit(); err != nil {
+				t.Error(err)
+			}
+		}))
+		defer ts.Close()
+
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Error(err)
+		}
+		res.Body.Close()
+	})
+}
+
+func TestResponseWriterBuffer_MultipleFlushes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrapped := New(w)
+		f, ok := wrapped.(http.Flusher)
+		if !ok {
+			t.Error("expected wrapped writer to implement http.Flusher")
+			return
+		}
+		rwb, _ := Unwrap(wrapped)
+
+		if _, err := rwb.Write([]byte("chunk1 ")); err != nil {
+			t.Error(err)
+		}
+		f.Flush()
+
+		if _, err := rwb.Write([]byte("chunk2")); err != nil {
+			t.Error(err)
+		}
+		f.Flush()
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Error(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Error(err)
+	}
+	if string(b) != "chunk1 chunk2" {
+		t.Errorf("expected: %q got: %q", "chunk1 chunk2", string(b))
+	}
+}
+
+func TestResponseWriterBuffer_HijackWithoutWrite(t *testing.T) {
+	const raw = "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := New(w).(http.Hijacker)
+		if !ok {
+			t.Error("expected wrapped writer to implement http.Hijacker")
+			return
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte(raw)); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A Hijack against a writer that's had nothing written to it should hand over the raw
+	// connection untouched: no implicit "200 OK" response should have been committed
+	// ahead of the bytes the caller writes after taking over.
+	if string(got) != raw {
+		t.Errorf("expected: %q got: %q", raw, string(got))
+	}
+}
+
+// fakePusher adds a no-op http.Pusher to an http.ResponseWriter, since httptest's
+// servers don't negotiate HTTP/2 and so never expose one, for exercising doPush
+// without a real HTTP/2 server.
+type fakePusher struct {
+	http.ResponseWriter
+	pushed bool
+}
+
+func (f *fakePusher) Push(target string, opts *http.PushOptions) error {
+	f.pushed = true
+	return nil
+}
+
+func TestResponseWriterBuffer_PushThenWrite(t *testing.T) {
+	rec := httptest.NewRecorder()
+	fp := &fakePusher{ResponseWriter: rec}
+
+	wrapped := New(fp)
+	pusher, ok := wrapped.(http.Pusher)
+	if !ok {
+		t.Fatal("expected wrapped writer to implement http.Pusher")
+	}
+	if err := pusher.Push("/style.css", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !fp.pushed {
+		t.Error("expected Push to reach the underlying ResponseWriter")
+	}
+
+	// Push happens before the main response is written; the handler should still be
+	// able to write and commit its own response afterwards.
+	rwb, _ := Unwrap(wrapped)
+	if _, err := rwb.Write([]byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if _, err := rwb.Commit(); err != nil {
+		t.Error(err)
+	}
+	if rec.Body.String() != "hello" {
+		t.Errorf("expected: %q got: %q", "hello", rec.Body.String())
+	}
+}
+
+// fakeCloseNotifier adds an http.CloseNotifier to an http.ResponseWriter, for
+// exercising doCloseNotify directly.
+type fakeCloseNotifier struct {
+	http.ResponseWriter
+	ch chan bool
+}
+
+func (f *fakeCloseNotifier) CloseNotify() <-chan bool { return f.ch }
+
+func TestResponseWriterBuffer_CloseNotifyThenWrite(t *testing.T) {
+	rec := httptest.NewRecorder()
+	fc := &fakeCloseNotifier{ResponseWriter: rec, ch: make(chan bool)}
+
+	wrapped := New(fc)
+	notifier, ok := wrapped.(http.CloseNotifier)
+	if !ok {
+		t.Fatal("expected wrapped writer to implement http.CloseNotifier")
+	}
+	// CloseNotify is conventionally called at the start of a handler, before anything's
+	// been written.
+	_ = notifier.CloseNotify()
+
+	rwb, _ := Unwrap(wrapped)
+	if _, err := rwb.Write([]byte("hello")); err != nil {
+		t.Error(err)
+	}
+	if _, err := rwb.Commit(); err != nil {
+		t.Error(err)
+	}
+	if rec.Body.String() != "hello" {
+		t.Errorf("expected: %q got: %q", "hello", rec.Body.String())
+	}
+}